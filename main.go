@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
-	"io/fs"
+	"flag"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"fmt"
 	"github.com/pelletier/go-toml"
-	"io"
 	"net/http"
 	"os"
 	"os/exec"
@@ -16,12 +19,101 @@ import (
 	"regexp"
 	"syscall"
 
-	"golang.org/x/oauth2"
-
-	"github.com/google/go-github/v68/github"
+	"golang.org/x/sync/errgroup"
 )
 
+// Target describes a single (stack, arch) combination we compile CPython
+// for. The Dockerfile is resolved relative to dependency/actions/compile in
+// the buildpack source, and MediaType is the media type this target's .tgz
+// artifacts are uploaded with (sidecars get their own fixed media types).
+type Target struct {
+	Stack      string
+	Arch       string
+	Dockerfile string
+	MediaType  string
+}
+
+// String returns the "<stack>/<arch>" form used in logs and error messages.
+func (t Target) String() string {
+	return t.Stack + "/" + t.Arch
+}
+
+// triple returns the target triple used in provenance metadata for t.Arch.
+func (t Target) triple() string {
+	switch t.Arch {
+	case "arm64":
+		return "aarch64-linux-gnu"
+	case "amd64":
+		return "x86_64-linux-gnu"
+	default:
+		return t.Arch + "-linux-gnu"
+	}
+}
+
+// buildWindow records when a single version's compile job started and
+// finished, for inclusion in its build provenance.
+type buildWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// getImageDigest returns the content digest of a locally built docker image,
+// recorded in provenance as the builder identity.
+func getImageDigest(ctx context.Context, image string) (string, error) {
+	cmd := exec.CommandContext(ctx, "docker", "inspect", "--format={{.Id}}", image)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot inspect image %s: %w", image, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// targets is the build matrix this tool compiles CPython for. Add an entry
+// here to pick up a new stack/arch combination.
+var targets = []Target{
+	{Stack: "jammy", Arch: "arm64", Dockerfile: "jammy.Dockerfile", MediaType: "application/gzip"},
+	{Stack: "jammy", Arch: "amd64", Dockerfile: "jammy.Dockerfile", MediaType: "application/gzip"},
+	{Stack: "bionic", Arch: "arm64", Dockerfile: "bionic.Dockerfile", MediaType: "application/gzip"},
+	{Stack: "noble", Arch: "amd64", Dockerfile: "noble.Dockerfile", MediaType: "application/gzip"},
+}
+
+// jobsFlag bounds how many versions are compiled concurrently. It defaults
+// to CPYTHON_DIST_JOBS, falling back to the number of CPUs if that is unset.
+var jobsFlag = flag.Int("jobs", defaultJobs(), "number of versions to compile concurrently")
+
+// forceFlag controls what happens when an asset with the target name
+// already exists on the release: by default uploadAsset skips it, but
+// -force deletes and re-uploads it instead.
+var forceFlag = flag.Bool("force", false, "delete and re-upload assets that already exist on the release")
+
+// publisherFlag selects the artifact store backend artifacts are published
+// to. destFlag is its destination, interpreted per backend (ignored for
+// "github", which always publishes to the hardcoded v0.0.0 release).
+var publisherFlag = flag.String("publisher", "github", "artifact store backend: github, gcs, s3, or oci")
+var destFlag = flag.String("dest", "", "backend-specific destination, e.g. gs://bucket/prefix, s3://bucket/prefix, or oci://registry/repo")
+
+func defaultJobs() int {
+	if s := os.Getenv("CPYTHON_DIST_JOBS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			return n
+		}
+	}
+	return runtime.NumCPU()
+}
+
+// jobs returns the effective worker pool size for g.SetLimit, clamping
+// -jobs to at least 1: errgroup.SetLimit treats a limit of zero as "block
+// forever", so -jobs=0 would hang the whole build instead of erroring.
+func jobs() int {
+	if *jobsFlag < 1 {
+		return 1
+	}
+	return *jobsFlag
+}
+
 func main() {
+	flag.Parse()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	sigs := make(chan os.Signal, 1)
@@ -51,73 +143,123 @@ func run(ctx context.Context) error {
 		return fmt.Errorf("cannot get versions: %w", err)
 	}
 
-	compiledVersions, err := getCompiledVersions(ctx)
+	out, err := os.MkdirTemp("", "")
 	if err != nil {
-		return fmt.Errorf("cannot get compiled versions: %w", err)
-	}
-
-	versionsToCompile := make([]string, 0, len(versions))
-	for v, _ := range versions {
-		if _, ok := compiledVersions[v]; !ok {
-			versionsToCompile = append(versionsToCompile, v)
-		}
-	}
-	if len(versionsToCompile) == 0 {
-		fmt.Println("all required versions are already built")
-		return nil
+		return fmt.Errorf("cannot create temp for artifacts: %w", err)
 	}
 
-	builderImage := "compilation"
-	cmd := exec.CommandContext(ctx, "docker",
-		"build",
-		filepath.Join(src, "dependency/actions/compile"),
-		"-t", builderImage,
-		"-f", filepath.Join(src, "dependency/actions/compile/jammy.Dockerfile"),
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = append(os.Environ(), "BUILDKIT_PROGRESS=plain")
-	err = cmd.Run()
+	pub, err := newPublisher(ctx, *publisherFlag, *destFlag)
 	if err != nil {
-		return fmt.Errorf("cannot build builder image: %w", err)
+		return fmt.Errorf("cannot set up %s publisher: %w", *publisherFlag, err)
 	}
 
-	out, err := os.MkdirTemp("", "")
-	if err != nil {
-		return fmt.Errorf("cannot create temp for artifacts: %w", err)
-	}
+	var newlyPublished []publishedAsset
+	for _, target := range targets {
+		compiledVersions, err := getCompiledVersions(ctx, pub, target, versions)
+		if err != nil {
+			return fmt.Errorf("cannot get compiled versions for %s: %w", target, err)
+		}
 
-	for _, v := range versionsToCompile {
-		if _, ok := compiledVersions[v]; ok {
+		versionsToCompile := make([]string, 0, len(versions))
+		for v := range versions {
+			if _, ok := compiledVersions[v]; !ok {
+				versionsToCompile = append(versionsToCompile, v)
+			}
+		}
+		if len(versionsToCompile) == 0 {
+			fmt.Printf("all required versions are already built for %s\n", target)
 			continue
 		}
-		cmd = exec.CommandContext(ctx, "docker",
-			"run", fmt.Sprintf("-v%s:%s", out, "/home"),
-			builderImage,
-			"--version", v,
-			"--outputDir", "/home",
-			"--target", "jammy",
+
+		builderImage := "compilation-" + target.Stack
+		cmd := exec.CommandContext(ctx, "docker",
+			"buildx", "build",
+			filepath.Join(src, "dependency/actions/compile"),
+			"-t", builderImage,
+			"-f", filepath.Join(src, "dependency/actions/compile", target.Dockerfile),
+			"--platform=linux/"+target.Arch,
+			"--load",
 		)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		cmd.Env = append(os.Environ(), "BUILDKIT_PROGRESS=plain")
 		err = cmd.Run()
 		if err != nil {
-			return fmt.Errorf("cannot build cpython: %w", err)
+			return fmt.Errorf("cannot build builder image for %s: %w", target, err)
 		}
-	}
-	err = filepath.Walk(out, func(p string, fi fs.FileInfo, err error) error {
+
+		builderDigest, err := getImageDigest(ctx, builderImage)
 		if err != nil {
-			return err
+			return fmt.Errorf("cannot get builder image digest for %s: %w", target, err)
+		}
+
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(jobs())
+		var buildTimes sync.Map // v -> buildWindow
+
+		for _, v := range versionsToCompile {
+			v := v
+			versionOut := filepath.Join(out, target.Stack+"-"+target.Arch+"-"+v)
+			if err := os.MkdirAll(versionOut, 0o755); err != nil {
+				return fmt.Errorf("cannot create output dir for %s %s: %w", v, target, err)
+			}
+
+			g.Go(func() error {
+				start := time.Now()
+				err := compileVersion(gctx, out, versionOut, builderImage, target, v)
+				buildTimes.Store(v, buildWindow{start: start, end: time.Now()})
+				return err
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return fmt.Errorf("error while compiling for %s: %w", target, err)
 		}
-		if strings.HasSuffix(p, ".tgz") || strings.HasSuffix(p, ".tgz.checksum") {
-			err = uploadAsset(ctx, p)
+
+		for _, v := range versionsToCompile {
+			versionOut := filepath.Join(out, target.Stack+"-"+target.Arch+"-"+v)
+			bw, _ := buildTimes.Load(v)
+			published, err := publishVersion(ctx, pub, versionOut, target, v, builderDigest, bw.(buildWindow))
+			if err != nil {
+				return fmt.Errorf("error while processing artifacts for %s %s: %w", v, target, err)
+			}
+			newlyPublished = append(newlyPublished, published...)
 		}
-		return err
-	})
+	}
+
+	if err := syncBuildpackToml(ctx, newlyPublished); err != nil {
+		return fmt.Errorf("cannot sync paketo-buildpacks/cpython buildpack.toml: %w", err)
+	}
+	return nil
+}
+
+// compileVersion runs a single docker container to compile one CPython
+// version for target, streaming its combined output into a per-version log
+// file under out and leaving a one-line summary on the parent stdout.
+func compileVersion(ctx context.Context, out, versionOut string, builderImage string, target Target, v string) error {
+	logPath := filepath.Join(out, target.Stack+"-"+target.Arch+"-"+v+".log")
+	logFile, err := os.Create(logPath)
 	if err != nil {
-		return fmt.Errorf("error while processing artifacts: %w", err)
+		return fmt.Errorf("cannot create log file for %s %s: %w", v, target, err)
 	}
+	defer logFile.Close()
+
+	cmd := exec.CommandContext(ctx, "docker",
+		"run", fmt.Sprintf("-v%s:%s", versionOut, "/home"),
+		"--platform=linux/"+target.Arch,
+		builderImage,
+		"--version", v,
+		"--outputDir", "/home",
+		"--target", target.Stack,
+	)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.Env = append(os.Environ(), "BUILDKIT_PROGRESS=plain")
+	err = cmd.Run()
+	if err != nil {
+		fmt.Printf("FAILED %s %s: %v (see %s)\n", v, target, err, logPath)
+		return fmt.Errorf("cannot build cpython %s for %s: %w", v, target, err)
+	}
+	fmt.Printf("OK %s %s (log: %s)\n", v, target, logPath)
 	return nil
 }
 
@@ -174,89 +316,86 @@ type data struct {
 	}
 }
 
-func getCompiledVersions(ctx context.Context) (map[string]struct{}, error) {
-	cli := newGHClient(ctx)
-
-	owner := "matejvasek"
-	repo := "cpython-dist"
-
-	rel, resp, err := cli.Repositories.GetReleaseByTag(ctx, owner, repo, "v0.0.0")
-	if err != nil {
-		return nil, fmt.Errorf("cannot list releases: %w", err)
-	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
-
-	versions := make(map[string]struct{}, len(rel.Assets))
-
-	r := regexp.MustCompile(`python_(\d+\.\d+\.\d+)_linux_arm64`)
-	for _, a := range rel.Assets {
-		matches := r.FindStringSubmatch(a.GetName())
-		if len(matches) != 2 {
-			continue
+// getCompiledVersions returns the subset of versions already published to
+// pub for target, keyed on the (version, stack, arch) asset name so that
+// multiple targets can be tracked independently on the same backend.
+func getCompiledVersions(ctx context.Context, pub Publisher, target Target, versions map[string]struct{}) (map[string]struct{}, error) {
+	compiled := make(map[string]struct{}, len(versions))
+	for v := range versions {
+		key, _ := assetKey(fmt.Sprintf("python_%s.tgz", v), target)
+		ok, err := pub.Exists(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot check %s: %w", key, err)
+		}
+		if ok {
+			compiled[v] = struct{}{}
 		}
-		versions[matches[1]] = struct{}{}
 	}
-	return versions, nil
+	return compiled, nil
 }
 
-func uploadAsset(ctx context.Context, p string) error {
-
-	name := filepath.Base(p)
-	name = strings.ReplaceAll(name, "_x64_", "_arm64_")
+// assetKey derives the published name and media type for the artifact at p,
+// replacing any builder-assigned hash infix and appending the
+// "<stack>_linux_<arch>" suffix that distinguishes it from other targets.
+// Sidecars (.checksum, .sha256, .provenance.json, .sig, .pem) are named by
+// appending a suffix after ".tgz", so the split happens there rather than on
+// the last dot, to keep the whole suffix intact.
+func assetKey(p string, target Target) (name, mediaType string) {
+	name = filepath.Base(p)
 
 	r := regexp.MustCompile(`_[a-fA-F0-9]{8}.`)
-
 	name = r.ReplaceAllString(name, ".")
-	var mediaType string
+
+	core, suffix := name, ""
+	if i := strings.Index(name, ".tgz"); i != -1 {
+		core, suffix = name[:i], name[i:]
+	}
+	core = regexp.MustCompile(`_linux_\w+$`).ReplaceAllString(core, "")
+	name = fmt.Sprintf("%s_%s_linux_%s%s", core, target.Stack, target.Arch, suffix)
+
 	switch {
 	case strings.HasSuffix(name, ".tgz"):
-		mediaType = "application/gzip"
-	case strings.HasSuffix(name, ".sha256"):
-	case strings.HasSuffix(name, ".checksum"):
+		mediaType = target.MediaType
+	case strings.HasSuffix(name, ".tgz.checksum"):
+		mediaType = "text/plain"
+	case strings.HasSuffix(name, ".tgz.sha256"):
 		mediaType = "text/plain"
+	case strings.HasSuffix(name, ".tgz.provenance.json"):
+		mediaType = "application/vnd.in-toto+json"
+	case strings.HasSuffix(name, ".tgz.sig"):
+		mediaType = "text/plain"
+	case strings.HasSuffix(name, ".tgz.pem"):
+		mediaType = "application/x-pem-file"
 	default:
 		mediaType = "application/octet-stream"
 	}
+	return name, mediaType
+}
 
-	var uploadOptions = &github.UploadOptions{
-		Name:      name,
-		MediaType: mediaType,
-	}
-	fmt.Printf("UPLOAD: %+v\n", uploadOptions)
-
-	cli := newGHClient(ctx)
-
-	owner := "matejvasek"
-	repo := "cpython-dist"
+// uploadAsset publishes the artifact at p to pub under the target's asset
+// name, skipping it if an asset with that name already exists unless
+// -force is set.
+func uploadAsset(ctx context.Context, pub Publisher, p string, target Target) error {
+	key, mediaType := assetKey(p, target)
 
-	rel, resp, err := cli.Repositories.GetReleaseByTag(ctx, owner, repo, "v0.0.0")
+	exists, err := pub.Exists(ctx, key)
 	if err != nil {
-		return fmt.Errorf("cannot list releases: %w", err)
+		return fmt.Errorf("cannot check %s: %w", key, err)
+	}
+	if exists && !*forceFlag {
+		fmt.Printf("SKIP: %s already exists\n", key)
+		return nil
 	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
 
 	f, err := os.Open(p)
 	if err != nil {
 		return fmt.Errorf("cannot open file: %w", err)
 	}
+	defer f.Close()
 
-	_, resp, err = cli.Repositories.UploadReleaseAsset(ctx, owner, repo, rel.GetID(), uploadOptions, f)
-	if err != nil {
-		return fmt.Errorf("cannot upload asset: %w", err)
+	fmt.Printf("UPLOAD: %s (%s)\n", key, mediaType)
+	if err := pub.Put(ctx, key, mediaType, f); err != nil {
+		return fmt.Errorf("cannot upload %s: %w", key, err)
 	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
-
 	return nil
 }
-
-func newGHClient(ctx context.Context) *github.Client {
-	return github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{
-		AccessToken: os.Getenv("GITHUB_TOKEN"),
-	})))
-}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+// TestAssetKeySidecarSuffix guards against a regression from chunk0-1, whose
+// original naming logic split on the last dot in the path and mangled
+// sidecar names like "python_3.11.9_linux_x64.tgz.checksum" into
+// "python_3.11.9_linux_x64.tgz_jammy_linux_arm64.checksum". assetKey must
+// split on ".tgz" instead, keeping the whole sidecar suffix intact.
+func TestAssetKeySidecarSuffix(t *testing.T) {
+	target := Target{Stack: "jammy", Arch: "arm64", MediaType: "application/gzip"}
+
+	got, mediaType := assetKey("/out/python_3.11.9_a1b2c3d4_linux_x64.tgz.checksum", target)
+	want := "python_3.11.9_jammy_linux_arm64.tgz.checksum"
+	if got != want {
+		t.Errorf("assetKey() name = %q, want %q", got, want)
+	}
+	if mediaType != "text/plain" {
+		t.Errorf("assetKey() mediaType = %q, want %q", mediaType, "text/plain")
+	}
+}
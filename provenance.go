@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cpythonSourceURL returns the upstream CPython source tarball URL for a
+// given version, recorded in provenance as the build's input material.
+func cpythonSourceURL(version string) string {
+	return fmt.Sprintf("https://www.python.org/ftp/python/%s/Python-%s.tgz", version, version)
+}
+
+// provenanceStatement is a minimal in-toto/SLSA v1.0 provenance statement
+// for a single compiled artifact.
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []provenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	BuildType  string               `json:"buildType"`
+	Builder    provenanceBuilder    `json:"builder"`
+	Invocation provenanceInvocation `json:"invocation"`
+	Metadata   provenanceMetadata   `json:"metadata"`
+}
+
+type provenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type provenanceInvocation struct {
+	ConfigSource provenanceConfigSource `json:"configSource"`
+	Parameters   map[string]string      `json:"parameters"`
+}
+
+type provenanceConfigSource struct {
+	URI string `json:"uri"`
+}
+
+type provenanceMetadata struct {
+	BuildStartedOn  time.Time `json:"buildStartedOn"`
+	BuildFinishedOn time.Time `json:"buildFinishedOn"`
+}
+
+// writeProvenance computes the sha256 digest of tgzPath and writes an
+// in-toto/SLSA provenance statement alongside it recording the builder
+// image, the CPython source, the target triple, and the build window.
+func writeProvenance(tgzPath string, target Target, version, builderDigest string, bw buildWindow) (sha256Hex string, provenancePath string, err error) {
+	sha256Hex, err = sha256File(tgzPath)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot hash %s: %w", tgzPath, err)
+	}
+
+	stmt := provenanceStatement{
+		Type: "https://in-toto.io/Statement/v1",
+		Subject: []provenanceSubject{{
+			Name:   filepath.Base(tgzPath),
+			Digest: map[string]string{"sha256": sha256Hex},
+		}},
+		PredicateType: "https://slsa.dev/provenance/v1",
+		Predicate: provenancePredicate{
+			BuildType: "https://github.com/matejvasek/cpython-dist/compile@v1",
+			Builder:   provenanceBuilder{ID: "docker-image:" + builderDigest},
+			Invocation: provenanceInvocation{
+				ConfigSource: provenanceConfigSource{URI: cpythonSourceURL(version)},
+				Parameters: map[string]string{
+					"version": version,
+					"stack":   target.Stack,
+					"arch":    target.Arch,
+					"triple":  target.triple(),
+				},
+			},
+			Metadata: provenanceMetadata{
+				BuildStartedOn:  bw.start,
+				BuildFinishedOn: bw.end,
+			},
+		},
+	}
+	if runID := os.Getenv("GITHUB_RUN_ID"); runID != "" {
+		stmt.Predicate.Invocation.Parameters["githubRunID"] = runID
+	}
+	if repo := os.Getenv("GITHUB_REPOSITORY"); repo != "" {
+		stmt.Predicate.Invocation.Parameters["githubRepository"] = repo
+	}
+	if sha := os.Getenv("GITHUB_SHA"); sha != "" {
+		stmt.Predicate.Invocation.Parameters["githubSHA"] = sha
+	}
+
+	b, err := json.MarshalIndent(stmt, "", "  ")
+	if err != nil {
+		return "", "", fmt.Errorf("cannot marshal provenance for %s: %w", tgzPath, err)
+	}
+
+	provenancePath = tgzPath + ".provenance.json"
+	if err := os.WriteFile(provenancePath, b, 0o644); err != nil {
+		return "", "", fmt.Errorf("cannot write provenance for %s: %w", tgzPath, err)
+	}
+	return sha256Hex, provenancePath, nil
+}
+
+// sha256File returns the lowercase hex sha256 digest of the file at path.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeSHA256Sidecar writes the "<digest>  <filename>\n" sidecar file
+// alongside tgzPath, in the conventional sha256sum format.
+func writeSHA256Sidecar(tgzPath, sha256Hex string) (string, error) {
+	sidecarPath := tgzPath + ".sha256"
+	content := fmt.Sprintf("%s  %s\n", sha256Hex, filepath.Base(tgzPath))
+	if err := os.WriteFile(sidecarPath, []byte(content), 0o644); err != nil {
+		return "", fmt.Errorf("cannot write sha256 sidecar for %s: %w", tgzPath, err)
+	}
+	return sidecarPath, nil
+}
+
+// cosignSign shells out to `cosign sign-blob` for tgzPath when keyless
+// signing is enabled via COSIGN_EXPERIMENTAL=1, returning the paths to the
+// signature and certificate it produced. It is a no-op, returning empty
+// paths, when keyless signing is not enabled.
+func cosignSign(ctx context.Context, tgzPath string) (sigPath, pemPath string, err error) {
+	if os.Getenv("COSIGN_EXPERIMENTAL") != "1" {
+		return "", "", nil
+	}
+
+	sigPath = tgzPath + ".sig"
+	pemPath = tgzPath + ".pem"
+	cmd := exec.CommandContext(ctx, "cosign", "sign-blob",
+		"--yes",
+		"--output-signature", sigPath,
+		"--output-certificate", pemPath,
+		tgzPath,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "COSIGN_EXPERIMENTAL=1")
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("cannot cosign sign %s: %w", tgzPath, err)
+	}
+	return sigPath, pemPath, nil
+}
+
+// publishVersion finalizes and uploads every artifact compiled for one
+// version of target: it generates a sha256 sidecar and SLSA provenance
+// statement for each .tgz, optionally signs it with cosign, uploads the
+// artifact along with all of its sidecars, and returns a publishedAsset
+// describing each .tgz it uploaded.
+func publishVersion(ctx context.Context, pub Publisher, versionOut string, target Target, version, builderDigest string, bw buildWindow) ([]publishedAsset, error) {
+	var tgzPaths []string
+	err := filepath.Walk(versionOut, func(p string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(p, ".tgz") {
+			tgzPaths = append(tgzPaths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot walk %s: %w", versionOut, err)
+	}
+
+	var published []publishedAsset
+	for _, tgzPath := range tgzPaths {
+		sha256Hex, provenancePath, err := writeProvenance(tgzPath, target, version, builderDigest, bw)
+		if err != nil {
+			return nil, err
+		}
+		sidecarPath, err := writeSHA256Sidecar(tgzPath, sha256Hex)
+		if err != nil {
+			return nil, err
+		}
+		sigPath, pemPath, err := cosignSign(ctx, tgzPath)
+		if err != nil {
+			return nil, err
+		}
+
+		assetPaths := []string{tgzPath, tgzPath + ".checksum", sidecarPath, provenancePath}
+		if sigPath != "" {
+			assetPaths = append(assetPaths, sigPath, pemPath)
+		}
+		for _, p := range assetPaths {
+			if p == tgzPath+".checksum" {
+				if _, err := os.Stat(p); err != nil {
+					continue
+				}
+			}
+			if err := uploadAsset(ctx, pub, p, target); err != nil {
+				return nil, fmt.Errorf("cannot upload %s: %w", p, err)
+			}
+		}
+
+		key, _ := assetKey(tgzPath, target)
+		published = append(published, publishedAsset{
+			Version: version,
+			Stack:   target.Stack,
+			URL:     pub.URL(key),
+			SHA256:  sha256Hex,
+		})
+	}
+	return published, nil
+}
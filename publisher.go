@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"golang.org/x/oauth2"
+
+	"github.com/google/go-github/v68/github"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+// Publisher is an artifact store backend that release assets are checked
+// against and uploaded to. key is the final asset name produced by
+// assetKey, the same across every backend, so a given artifact lands at the
+// same logical location regardless of which backend is selected.
+type Publisher interface {
+	Exists(ctx context.Context, key string) (bool, error)
+	Put(ctx context.Context, key, mediaType string, r io.Reader) error
+
+	// URL returns a reference to a previously-Put key suitable for
+	// recording in buildpack.toml's dependency "uri" field.
+	URL(key string) string
+}
+
+// newPublisher constructs the Publisher named by kind, pointed at dest.
+// dest is backend-specific and ignored for "github", which always publishes
+// to this repo's hardcoded v0.0.0 release.
+func newPublisher(ctx context.Context, kind, dest string) (Publisher, error) {
+	switch kind {
+	case "", "github":
+		return newGitHubPublisher(ctx), nil
+	case "gcs":
+		return newGCSPublisher(ctx, dest)
+	case "s3":
+		return newS3Publisher(ctx, dest)
+	case "oci":
+		return newOCIPublisher(dest)
+	default:
+		return nil, fmt.Errorf("unknown publisher %q (want github, gcs, s3, or oci)", kind)
+	}
+}
+
+// GitHubPublisher publishes assets to a GitHub release, the original and
+// default backend of this tool.
+type GitHubPublisher struct {
+	cli         *github.Client
+	owner, repo string
+	releaseTag  string
+}
+
+func newGitHubPublisher(ctx context.Context) *GitHubPublisher {
+	return &GitHubPublisher{
+		cli:        newGHClient(ctx),
+		owner:      "matejvasek",
+		repo:       "cpython-dist",
+		releaseTag: "v0.0.0",
+	}
+}
+
+func newGHClient(ctx context.Context) *github.Client {
+	return github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: os.Getenv("GITHUB_TOKEN"),
+	})))
+}
+
+func (p *GitHubPublisher) release(ctx context.Context) (*github.RepositoryRelease, error) {
+	rel, resp, err := p.cli.Repositories.GetReleaseByTag(ctx, p.owner, p.repo, p.releaseTag)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get release %s: %w", p.releaseTag, err)
+	}
+	defer resp.Body.Close()
+	return rel, nil
+}
+
+func (p *GitHubPublisher) Exists(ctx context.Context, key string) (bool, error) {
+	rel, err := p.release(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range rel.Assets {
+		if strings.HasSuffix(a.GetName(), ".uploading") {
+			// Left over from a crashed upload; not a complete artifact.
+			continue
+		}
+		if a.GetName() == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p *GitHubPublisher) URL(key string) string {
+	return fmt.Sprintf("https://github.com/%s/%s/releases/download/%s/%s", p.owner, p.repo, p.releaseTag, key)
+}
+
+func (p *GitHubPublisher) Put(ctx context.Context, key, mediaType string, r io.Reader) error {
+	// UploadReleaseAsset needs a *os.File (it stats it and reads its body on
+	// every retry), so spool r to disk once up front rather than assuming it
+	// is seekable.
+	tmp, err := os.CreateTemp("", "cpython-dist-asset-*")
+	if err != nil {
+		return fmt.Errorf("cannot create temp file for %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, r); err != nil {
+		return fmt.Errorf("cannot read %s: %w", key, err)
+	}
+
+	rel, err := p.release(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Delete any existing asset under the final name as well as any orphaned
+	// ".uploading" asset left by a crashed run, so re-uploading the temp name
+	// below never collides with a stale duplicate.
+	tmpName := key + ".uploading"
+	for _, a := range rel.Assets {
+		if a.GetName() != key && a.GetName() != tmpName {
+			continue
+		}
+		err = withRetry(ctx, func() (*github.Response, error) {
+			return p.cli.Repositories.DeleteReleaseAsset(ctx, p.owner, p.repo, a.GetID())
+		})
+		if err != nil {
+			return fmt.Errorf("cannot delete existing asset %s: %w", a.GetName(), err)
+		}
+	}
+
+	// Upload under a temporary name first and rename it into place once the
+	// transfer is complete, so a crash mid-upload never leaves a
+	// partial/corrupt asset under the final name for Exists to pick up on a
+	// retry.
+	uploadOptions := &github.UploadOptions{
+		Name:      tmpName,
+		MediaType: mediaType,
+	}
+
+	var asset *github.ReleaseAsset
+	err = withRetry(ctx, func() (*github.Response, error) {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("cannot rewind temp file for %s: %w", key, err)
+		}
+		a, resp, err := p.cli.Repositories.UploadReleaseAsset(ctx, p.owner, p.repo, rel.GetID(), uploadOptions, tmp)
+		asset = a
+		return resp, err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot upload asset: %w", err)
+	}
+
+	return withRetry(ctx, func() (*github.Response, error) {
+		_, resp, err := p.cli.Repositories.EditReleaseAsset(ctx, p.owner, p.repo, asset.GetID(), &github.ReleaseAsset{Name: github.String(key)})
+		return resp, err
+	})
+}
+
+const maxRetries = 5
+
+// withRetry runs fn, retrying with exponential backoff when the GitHub API
+// responds with a transient 5xx or a secondary-rate-limit 403/429, honoring
+// any Retry-After header it sends. Any other error is returned immediately.
+func withRetry(ctx context.Context, fn func() (*github.Response, error)) error {
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		var resp *github.Response
+		resp, err = fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryableResponse(resp) {
+			return err
+		}
+
+		wait := backoff
+		if resp.Response != nil {
+			if ra := resp.Response.Header.Get("Retry-After"); ra != "" {
+				if secs, perr := strconv.Atoi(ra); perr == nil {
+					wait = time.Duration(secs) * time.Second
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+func isRetryableResponse(resp *github.Response) bool {
+	if resp == nil || resp.Response == nil {
+		return false
+	}
+	switch {
+	case resp.StatusCode >= 500:
+		return true
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode == http.StatusForbidden && resp.Response.Header.Get("Retry-After") != "":
+		return true
+	default:
+		return false
+	}
+}
+
+// GCSPublisher publishes assets as objects in a Google Cloud Storage
+// bucket, under an optional key prefix.
+type GCSPublisher struct {
+	client *storage.Client
+	bucket string
+	prefix string
+}
+
+func newGCSPublisher(ctx context.Context, dest string) (*GCSPublisher, error) {
+	bucket, prefix, err := parseBucketDest(dest, "gs")
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create GCS client: %w", err)
+	}
+	return &GCSPublisher{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (p *GCSPublisher) object(key string) *storage.ObjectHandle {
+	return p.client.Bucket(p.bucket).Object(path.Join(p.prefix, key))
+}
+
+func (p *GCSPublisher) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := p.object(key).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot stat gs://%s/%s: %w", p.bucket, key, err)
+	}
+	return true, nil
+}
+
+func (p *GCSPublisher) URL(key string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", p.bucket, path.Join(p.prefix, key))
+}
+
+func (p *GCSPublisher) Put(ctx context.Context, key, mediaType string, r io.Reader) error {
+	w := p.object(key).NewWriter(ctx)
+	w.ContentType = mediaType
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("cannot write gs://%s/%s: %w", p.bucket, key, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot finalize gs://%s/%s: %w", p.bucket, key, err)
+	}
+	return nil
+}
+
+// S3Publisher publishes assets as objects in an S3 bucket, under an
+// optional key prefix.
+type S3Publisher struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Publisher(ctx context.Context, dest string) (*S3Publisher, error) {
+	bucket, prefix, err := parseBucketDest(dest, "s3")
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load AWS config: %w", err)
+	}
+	return &S3Publisher{client: s3.NewFromConfig(cfg), bucket: bucket, prefix: prefix}, nil
+}
+
+func (p *S3Publisher) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := p.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(path.Join(p.prefix, key)),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey") {
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot head s3://%s/%s: %w", p.bucket, key, err)
+	}
+	return true, nil
+}
+
+func (p *S3Publisher) URL(key string) string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", p.bucket, path.Join(p.prefix, key))
+}
+
+func (p *S3Publisher) Put(ctx context.Context, key, mediaType string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", key, err)
+	}
+	_, err = p.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(p.bucket),
+		Key:         aws.String(path.Join(p.prefix, key)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(mediaType),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot put s3://%s/%s: %w", p.bucket, key, err)
+	}
+	return nil
+}
+
+// parseBucketDest parses a "<scheme>://bucket/prefix" destination URL for
+// the GCS and S3 publishers.
+func parseBucketDest(dest, scheme string) (bucket, prefix string, err error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse -dest %q: %w", dest, err)
+	}
+	if u.Scheme != scheme || u.Host == "" {
+		return "", "", fmt.Errorf("-dest must look like %s://bucket/prefix, got %q", scheme, dest)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// cpythonLayerMediaType is the media type of the CPython tarball layer
+// pushed to an OCI registry. Sidecars keep the media type they were given.
+const cpythonLayerMediaType = "application/vnd.paketo.cpython.layer.v1+gzip"
+
+// cpythonConfigMediaType is the media type of the small config blob
+// recording version/stack/arch alongside the CPython layer.
+const cpythonConfigMediaType = "application/vnd.paketo.cpython.config.v1+json"
+
+// OCIPublisher publishes each artifact as a single-layer OCI artifact in a
+// registry, tagged after its asset key.
+type OCIPublisher struct {
+	repo *remote.Repository
+}
+
+func newOCIPublisher(dest string) (*OCIPublisher, error) {
+	ref := strings.TrimPrefix(dest, "oci://")
+	if ref == "" {
+		return nil, fmt.Errorf("-dest must be oci://registry/repo for the oci publisher")
+	}
+	repo, err := remote.NewRepository(ref)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve OCI repository %q: %w", ref, err)
+	}
+	repo.Client = &auth.Client{
+		Client: retry.DefaultClient,
+		Cache:  auth.NewCache(),
+		Credential: auth.StaticCredential(repo.Reference.Registry, auth.Credential{
+			Username: os.Getenv("OCI_USERNAME"),
+			Password: os.Getenv("OCI_PASSWORD"),
+		}),
+	}
+	return &OCIPublisher{repo: repo}, nil
+}
+
+func (p *OCIPublisher) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := p.repo.Resolve(ctx, ociTag(key))
+	if err != nil {
+		if errors.Is(err, errdef.ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot resolve %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (p *OCIPublisher) URL(key string) string {
+	return fmt.Sprintf("oci://%s/%s:%s", p.repo.Reference.Registry, p.repo.Reference.Repository, ociTag(key))
+}
+
+func (p *OCIPublisher) Put(ctx context.Context, key, mediaType string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", key, err)
+	}
+
+	layerMediaType := mediaType
+	if strings.HasSuffix(key, ".tgz") {
+		layerMediaType = cpythonLayerMediaType
+	}
+
+	version, stack, arch := parseAssetKey(key)
+	configBlob, err := json.Marshal(map[string]string{"version": version, "stack": stack, "arch": arch})
+	if err != nil {
+		return fmt.Errorf("cannot marshal OCI config for %s: %w", key, err)
+	}
+
+	store := memory.New()
+	layerDesc, err := pushBlob(ctx, store, layerMediaType, data)
+	if err != nil {
+		return fmt.Errorf("cannot stage layer for %s: %w", key, err)
+	}
+	configDesc, err := pushBlob(ctx, store, cpythonConfigMediaType, configBlob)
+	if err != nil {
+		return fmt.Errorf("cannot stage config for %s: %w", key, err)
+	}
+
+	manifestDesc, err := oras.PackManifest(ctx, store, oras.PackManifestVersion1_1, "application/vnd.paketo.cpython.manifest.v1+json", oras.PackManifestOptions{
+		ConfigDescriptor: &configDesc,
+		Layers:           []ocispec.Descriptor{layerDesc},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot pack manifest for %s: %w", key, err)
+	}
+
+	tag := ociTag(key)
+	if err := store.Tag(ctx, manifestDesc, tag); err != nil {
+		return fmt.Errorf("cannot tag %s: %w", key, err)
+	}
+
+	if _, err := oras.Copy(ctx, store, tag, p.repo, tag, oras.DefaultCopyOptions); err != nil {
+		return fmt.Errorf("cannot push %s: %w", key, err)
+	}
+	return nil
+}
+
+func pushBlob(ctx context.Context, store *memory.Store, mediaType string, data []byte) (ocispec.Descriptor, error) {
+	desc := content.NewDescriptorFromBytes(mediaType, data)
+	if err := store.Push(ctx, desc, bytes.NewReader(data)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// ociTag derives an OCI-tag-safe reference from an asset key.
+func ociTag(key string) string {
+	t := strings.ToLower(key)
+	return regexp.MustCompile(`[^a-z0-9._-]`).ReplaceAllString(t, "-")
+}
+
+// parseAssetKey extracts the version, stack, and arch encoded in an asset
+// key of the form "python_<version>_<stack>_linux_<arch>...".
+func parseAssetKey(key string) (version, stack, arch string) {
+	m := regexp.MustCompile(`python_(\d+\.\d+\.\d+)_(\w+)_linux_(\w+)`).FindStringSubmatch(key)
+	if len(m) != 4 {
+		return "", "", ""
+	}
+	return m[1], m[2], m[3]
+}
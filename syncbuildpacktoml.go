@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v68/github"
+)
+
+// publishedAsset records one newly-uploaded CPython artifact, as needed to
+// patch its buildpack.toml dependency entry.
+type publishedAsset struct {
+	Version string
+	Stack   string
+	URL     string
+	SHA256  string
+}
+
+// syncBuildpackToml clones paketo-buildpacks/cpython, bumps the buildpack.toml
+// dependency entry for every (version, stack) pair in assets to point at the
+// freshly-published artifact, and opens a PR with the result. It is a no-op
+// if assets is empty or none of them match an existing dependency entry.
+func syncBuildpackToml(ctx context.Context, assets []publishedAsset) error {
+	if len(assets) == 0 {
+		return nil
+	}
+
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return fmt.Errorf("GITHUB_TOKEN is required to open the buildpack.toml PR")
+	}
+
+	clone, err := os.MkdirTemp("", "")
+	if err != nil {
+		return fmt.Errorf("cannot create temp dir for clone: %w", err)
+	}
+	defer os.RemoveAll(clone)
+
+	// Pass the token as a one-off http.extraHeader rather than embedding it
+	// in the remote URL, so it never gets written to <clone>/.git/config.
+	authHeader := "http.extraheader=Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("x-access-token:"+token))
+	cloneURL := "https://github.com/paketo-buildpacks/cpython.git"
+	cmd := exec.CommandContext(ctx, "git", "-c", authHeader, "clone", "--depth=1", cloneURL, clone)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot clone paketo-buildpacks/cpython: %w", err)
+	}
+
+	branch := fmt.Sprintf("bot/cpython-dist-%d", time.Now().Unix())
+	cmd = exec.CommandContext(ctx, "git", "-C", clone, "checkout", "-b", branch)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot create branch %s: %w", branch, err)
+	}
+
+	tomlPath := filepath.Join(clone, "buildpack.toml")
+	content, err := os.ReadFile(tomlPath)
+	if err != nil {
+		return fmt.Errorf("cannot read buildpack.toml: %w", err)
+	}
+
+	patched, bumped, err := patchBuildpackToml(ctx, string(content), assets)
+	if err != nil {
+		return fmt.Errorf("cannot patch buildpack.toml: %w", err)
+	}
+	if len(bumped) == 0 {
+		fmt.Println("no buildpack.toml dependency entries matched newly-uploaded versions")
+		return nil
+	}
+
+	if err := os.WriteFile(tomlPath, []byte(patched), 0o644); err != nil {
+		return fmt.Errorf("cannot write buildpack.toml: %w", err)
+	}
+
+	cmd = exec.CommandContext(ctx, "git", "-C", clone, "add", "buildpack.toml")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot stage buildpack.toml: %w", err)
+	}
+
+	commitMsg := fmt.Sprintf("Bump CPython dependencies: %s", strings.Join(bumped, ", "))
+	cmd = exec.CommandContext(ctx, "git", "-C", clone, "commit", "-m", commitMsg)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=cpython-dist-bot", "GIT_AUTHOR_EMAIL=cpython-dist-bot@users.noreply.github.com",
+		"GIT_COMMITTER_NAME=cpython-dist-bot", "GIT_COMMITTER_EMAIL=cpython-dist-bot@users.noreply.github.com",
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot commit buildpack.toml: %w", err)
+	}
+
+	cmd = exec.CommandContext(ctx, "git", "-c", authHeader, "-C", clone, "push", "origin", branch)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot push branch %s: %w", branch, err)
+	}
+
+	// Cloning, committing, and pushing shell out to the git CLI rather than
+	// the Git Data API: they're plain local working-tree operations with no
+	// natural go-github equivalent, and shelling out is the more practical
+	// choice here. Only the PR itself needs the GitHub API.
+	cli := newGHClient(ctx)
+	body := pullRequestBody(assets, bumped)
+	_, resp, err := cli.PullRequests.Create(ctx, "paketo-buildpacks", "cpython", &github.NewPullRequest{
+		Title: github.String("Bump CPython dependencies"),
+		Head:  github.String(branch),
+		Base:  github.String("main"),
+		Body:  github.String(body),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot open buildpack.toml PR: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// patchBuildpackToml rewrites every [[metadata.dependencies]] entry in
+// content whose version and stack match one of assets, updating its uri,
+// sha256, source, and source_sha256 fields in place. It returns the
+// versions it actually bumped.
+//
+// This assumes metadata.dependencies is the last array-of-tables section in
+// the file, so each entry can be isolated by splitting on the
+// "[[metadata.dependencies]]" marker.
+func patchBuildpackToml(ctx context.Context, content string, assets []publishedAsset) (string, []string, error) {
+	byVersion := make(map[string][]publishedAsset)
+	for _, a := range assets {
+		byVersion[a.Version] = append(byVersion[a.Version], a)
+	}
+
+	sourceSHA256Cache := make(map[string]string)
+
+	marker := "[[metadata.dependencies]]"
+	parts := strings.Split(content, marker)
+
+	bumpedSet := make(map[string]struct{})
+	for i := 1; i < len(parts); i++ {
+		version := tomlStringField(parts[i], "version")
+		candidates, ok := byVersion[version]
+		if !ok {
+			continue
+		}
+
+		stacks := tomlStringListField(parts[i], "stacks")
+		var asset *publishedAsset
+		for j := range candidates {
+			if stringsContain(stacks, candidates[j].Stack) {
+				asset = &candidates[j]
+				break
+			}
+		}
+		if asset == nil {
+			continue
+		}
+
+		sourceURL := cpythonSourceURL(version)
+		sourceSHA, ok := sourceSHA256Cache[version]
+		if !ok {
+			var err error
+			sourceSHA, err = fetchSHA256(ctx, sourceURL)
+			if err != nil {
+				return "", nil, fmt.Errorf("cannot hash source for %s: %w", version, err)
+			}
+			sourceSHA256Cache[version] = sourceSHA
+		}
+
+		block := parts[i]
+		block, okURI := setTomlField(block, "uri", asset.URL)
+		block, okSHA := setTomlField(block, "sha256", asset.SHA256)
+		block, _ = setTomlField(block, "source", sourceURL)
+		block, _ = setTomlField(block, "source_sha256", sourceSHA)
+		parts[i] = block
+
+		if okURI && okSHA {
+			bumpedSet[version] = struct{}{}
+		}
+	}
+
+	bumped := make([]string, 0, len(bumpedSet))
+	for v := range bumpedSet {
+		bumped = append(bumped, v)
+	}
+	return strings.Join(parts, marker), bumped, nil
+}
+
+// setTomlField replaces the value of an existing "key = ..." line within
+// block, leaving block untouched if key is not present.
+func setTomlField(block, key, value string) (string, bool) {
+	re := regexp.MustCompile(`(?m)^(\s*` + regexp.QuoteMeta(key) + `\s*=\s*).*$`)
+	if !re.MatchString(block) {
+		return block, false
+	}
+	return re.ReplaceAllString(block, `${1}"`+value+`"`), true
+}
+
+func tomlStringField(block, key string) string {
+	re := regexp.MustCompile(`(?m)^\s*` + regexp.QuoteMeta(key) + `\s*=\s*"([^"]*)"`)
+	m := re.FindStringSubmatch(block)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+func tomlStringListField(block, key string) []string {
+	re := regexp.MustCompile(`(?ms)^\s*` + regexp.QuoteMeta(key) + `\s*=\s*\[(.*?)\]`)
+	m := re.FindStringSubmatch(block)
+	if m == nil {
+		return nil
+	}
+	var values []string
+	for _, s := range regexp.MustCompile(`"([^"]*)"`).FindAllStringSubmatch(m[1], -1) {
+		values = append(values, s[1])
+	}
+	return values
+}
+
+func stringsContain(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchSHA256 downloads url and returns the lowercase hex sha256 digest of
+// its body, without writing it to disk.
+func fetchSHA256(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s fetching %s", resp.Status, url)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pullRequestBody summarizes the versions bumped and the assets backing
+// them for the buildpack.toml dependency bump PR description.
+func pullRequestBody(assets []publishedAsset, bumped []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Bumps the following CPython versions compiled by cpython-dist:\n\n")
+	for _, v := range bumped {
+		fmt.Fprintf(&b, "- %s\n", v)
+	}
+	fmt.Fprintf(&b, "\nAssets:\n\n")
+	for _, a := range assets {
+		fmt.Fprintf(&b, "- %s (%s): %s\n", a.Version, a.Stack, a.URL)
+	}
+	return b.String()
+}